@@ -34,7 +34,7 @@ func (bindRequest *SimpleBindRequest) encode() *ber.Packet {
 	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, bindRequest.Username, "User Name"))
 	request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, bindRequest.Password, "Password"))
 
-	request.AppendChild(encodeControls(bindRequest.Controls))
+	request.AppendChild(EncodeControls(bindRequest.Controls))
 
 	return request
 }
@@ -72,16 +72,14 @@ func (l *Conn) SimpleBind(simpleBindRequest *SimpleBindRequest) (*SimpleBindResu
 		ber.PrintPacket(packet)
 	}
 
-	result := &SimpleBindResult{
-		Controls: make([]Control, 0),
-	}
-
-	if len(packet.Children) == 3 {
-		for _, child := range packet.Children[2].Children {
-			result.Controls = append(result.Controls, DecodeControl(child))
-		}
+	// the result code is what the caller needs to know, so don't replace
+	// it by an error for undecodable controls
+	controls, err := DecodeResponseControls(packet)
+	if err != nil {
+		l.Debug.Printf("%d: ignoring controls: %s", msgCtx.id, err)
+		controls = []Control{}
 	}
-
+	result := &SimpleBindResult{Controls: controls}
 	resultCode, resultDescription := getLDAPResultCode(packet)
 	if resultCode != 0 {
 		return result, NewError(resultCode, errors.New(resultDescription))
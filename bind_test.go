@@ -0,0 +1,47 @@
+package ldap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSimpleBindResultControls(t *testing.T) {
+	warning := &ControlVChuPasswordWarning{Expire: 3600}
+	soon := NewControlString(ControlTypeVChuPasswordWarning, false, "soon")
+	tests := []struct {
+		name       string
+		resultCode int
+		controls   []Control
+		expected   []Control
+		errorCode  uint8
+	}{
+		{"success", LDAPResultSuccess, []Control{NewControlString(ControlTypeVChuPasswordWarning, false, "3600")}, []Control{warning}, 0},
+		{"invalid credentials", LDAPResultInvalidCredentials, nil, []Control{}, LDAPResultInvalidCredentials},
+		// a broken control must neither hide the result of the bind nor
+		// the other controls
+		{"invalid credentials and control", LDAPResultInvalidCredentials, []Control{soon, NewControlString(ControlTypeVChuPasswordWarning, false, "3600")}, []Control{soon, warning}, LDAPResultInvalidCredentials},
+		{"invalid control", LDAPResultSuccess, []Control{soon}, []Control{soon}, 0},
+	}
+	for _, test := range tests {
+		ptc := newPacketTranslatorConn()
+		conn := NewConn(ptc, false)
+		conn.Start()
+		go testRespond(t, ptc, testResult(ApplicationBindResponse, test.resultCode), EncodeControls(test.controls))
+
+		result, err := conn.SimpleBind(NewSimpleBindRequest("cn=test,dc=example,dc=org", "secret", nil))
+		if test.errorCode == 0 && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if test.errorCode != 0 && !IsErrorWithCode(err, test.errorCode) {
+			t.Errorf("%s: expected error code %d, got %v", test.name, test.errorCode, err)
+		}
+		if test.expected == nil {
+			if result != nil {
+				t.Errorf("%s: expected no result, got %v", test.name, result)
+			}
+		} else if result == nil || !reflect.DeepEqual(result.Controls, test.expected) {
+			t.Errorf("%s: expected controls %v, got %v", test.name, test.expected, result)
+		}
+		conn.Close()
+		ptc.Close()
+	}
+}
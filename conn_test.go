@@ -173,6 +173,35 @@ func testSendUnhandledResponsesAndFinish(t *testing.T, ptc *packetTranslatorConn
 	})
 }
 
+// testRespond answers the next request sent on ptc with a response made of
+// the given protocol op and controls wrapper (if not nil), like a server
+// would.
+func testRespond(t *testing.T, ptc *packetTranslatorConn, protocolOp *ber.Packet, controls *ber.Packet) {
+	request, err := ptc.ReceiveRequest()
+	if err != nil {
+		t.Errorf("unable to receive request packet: %s", err)
+		return
+	}
+	response := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, request.Children[0].Value, "MessageID"))
+	response.AppendChild(protocolOp)
+	if controls != nil {
+		response.AppendChild(controls)
+	}
+	if err := ptc.SendResponse(response); err != nil {
+		t.Errorf("unable to send response packet: %s", err)
+	}
+}
+
+// testResult returns an LDAPResult protocol op with the given result code
+func testResult(tag ber.Tag, resultCode int) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, resultCode, "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, LDAPResultCodeMap[uint8(resultCode)], "Error Message"))
+	return result
+}
+
 func runWithTimeout(t *testing.T, timeout time.Duration, f func()) {
 	runtime.Gosched()
 
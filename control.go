@@ -5,8 +5,14 @@
 package ldap
 
 import (
+	"bytes"
+	enchex "encoding/hex"
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/asn1-ber.v1"
 )
@@ -17,12 +23,14 @@ const (
 	ControlTypeVChuPasswordMustChange = "2.16.840.1.113730.3.4.4"
 	ControlTypeVChuPasswordWarning    = "2.16.840.1.113730.3.4.5"
 	ControlTypeManageDsaIT            = "2.16.840.1.113730.3.4.2"
+	ControlTypeMicrosoftQuota         = "1.2.840.113556.1.4.1852"
 )
 
 var ControlTypeMap = map[string]string{
 	ControlTypePaging:               "Paging",
 	ControlTypeBeheraPasswordPolicy: "Password Policy - Behera Draft",
 	ControlTypeManageDsaIT:          "Manage DSA IT",
+	ControlTypeMicrosoftQuota:       "Microsoft Quota",
 }
 
 type Control interface {
@@ -55,9 +63,32 @@ func (c *ControlString) String() string {
 	return fmt.Sprintf("Control Type: %s (%q)  Criticality: %t  Control Value: %s", ControlTypeMap[c.ControlType], c.ControlType, c.Criticality, c.ControlValue)
 }
 
+// Cookie is an opaque value handed out by the server to continue an
+// operation, e.g. to fetch the next page of a paged search. It has no
+// structure a client may rely on and must be sent back as received.
+type Cookie []byte
+
+// IsEmpty returns true if the cookie is nil or empty, which the server
+// uses to signal that there's nothing more to continue.
+func (c Cookie) IsEmpty() bool {
+	return len(c) == 0
+}
+
+// Equal returns true if both cookies have the same content, a nil and an
+// empty cookie are equal. Use it to check whether a saved cookie is the
+// one to resume from.
+func (c Cookie) Equal(other Cookie) bool {
+	return bytes.Equal(c, other)
+}
+
+// String returns the cookie hex encoded for logging.
+func (c Cookie) String() string {
+	return enchex.EncodeToString(c)
+}
+
 type ControlPaging struct {
 	PagingSize uint32
-	Cookie     []byte
+	Cookie     Cookie
 }
 
 func (c *ControlPaging) GetControlType() string {
@@ -66,13 +97,13 @@ func (c *ControlPaging) GetControlType() string {
 
 func (c *ControlPaging) Encode() *ber.Packet {
 	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
-	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ControlTypePaging, "Control Type ("+ControlTypeMap[ControlTypePaging]+")"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ControlTypePaging, "Control Type (Paging)"))
 
 	p2 := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value (Paging)")
 	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Search Control Value")
 	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, uint64(c.PagingSize), "Paging Size"))
 	cookie := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Cookie")
-	cookie.Value = c.Cookie
+	cookie.Value = []byte(c.Cookie)
 	cookie.Data.Write(c.Cookie)
 	seq.AppendChild(cookie)
 	p2.AppendChild(seq)
@@ -95,6 +126,24 @@ func (c *ControlPaging) SetCookie(cookie []byte) {
 	c.Cookie = cookie
 }
 
+// WithCookie sets the cookie like SetCookie and returns the control, so
+// it can be chained with NewControlPaging. Only pass cookies returned in
+// a paging control, cookies of other controls (e.g. DirSync) are not
+// interchangeable even though all of them are opaque bytes.
+func (c *ControlPaging) WithCookie(cookie []byte) *ControlPaging {
+	c.SetCookie(cookie)
+	return c
+}
+
+// Stalled reports whether the cookie of this paging control, as returned by
+// the server, is the same non-empty cookie as the one of the previous page.
+// This usually means the server lost or reset the search and requesting the
+// next page would loop forever. It's a best effort check only, a server is
+// free to return the same cookie for different pages.
+func (c *ControlPaging) Stalled(prev []byte) bool {
+	return !c.Cookie.IsEmpty() && bytes.Equal(c.Cookie, prev)
+}
+
 type ControlBeheraPasswordPolicy struct {
 	Expire      int64
 	Grace       int64
@@ -127,6 +176,9 @@ func (c *ControlBeheraPasswordPolicy) String() string {
 
 type ControlVChuPasswordMustChange struct {
 	MustChange bool
+	// Expired is set if the control value is "0", i.e. the password has
+	// expired. Any other value means it must be changed after a reset.
+	Expired bool
 }
 
 func (c *ControlVChuPasswordMustChange) GetControlType() string {
@@ -139,11 +191,12 @@ func (c *ControlVChuPasswordMustChange) Encode() *ber.Packet {
 
 func (c *ControlVChuPasswordMustChange) String() string {
 	return fmt.Sprintf(
-		"Control Type: %s (%q)  Criticality: %t  MustChange: %b",
+		"Control Type: %s (%q)  Criticality: %t  MustChange: %t  Expired: %t",
 		ControlTypeMap[ControlTypeVChuPasswordMustChange],
 		ControlTypeVChuPasswordMustChange,
 		false,
-		c.MustChange)
+		c.MustChange,
+		c.Expired)
 }
 
 type ControlVChuPasswordWarning struct {
@@ -197,6 +250,77 @@ func NewControlManageDsaIT(Criticality bool) *ControlManageDsaIT {
 	return &ControlManageDsaIT{Criticality: Criticality}
 }
 
+// ReferralHandling selects how a server should treat referral objects in
+// the scope of an operation, see ControlsForReferrals.
+type ReferralHandling int
+
+const (
+	// ReferralsFollow lets the server return referrals (continuation
+	// references in searches), which the client may follow
+	ReferralsFollow ReferralHandling = iota
+	// ReferralsAsEntries makes the server treat referral objects as
+	// normal entries, e.g. to modify or delete them
+	ReferralsAsEntries
+)
+
+var ReferralHandlingMap = map[ReferralHandling]string{
+	ReferralsFollow:    "Follow Referrals",
+	ReferralsAsEntries: "Referrals As Entries",
+}
+
+// ControlsForReferrals returns the request controls for the given referral
+// handling. Following referrals is the default and needs no control, for
+// treating referrals as entries a critical ManageDsaIT control is returned,
+// so a server not supporting it fails the operation instead of silently
+// returning referrals.
+func ControlsForReferrals(mode ReferralHandling) []Control {
+	switch mode {
+	case ReferralsAsEntries:
+		return []Control{NewControlManageDsaIT(true)}
+	}
+	return nil
+}
+
+// ControlMicrosoftQuota asks an Active Directory server to report the quota
+// of the security principal identified by QuerySID instead of the one of
+// the bound user. The SID is kept in its binary form.
+type ControlMicrosoftQuota struct {
+	QuerySID []byte
+}
+
+func (c *ControlMicrosoftQuota) GetControlType() string {
+	return ControlTypeMicrosoftQuota
+}
+
+func (c *ControlMicrosoftQuota) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ControlTypeMicrosoftQuota, "Control Type (Microsoft Quota)"))
+
+	p2 := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value (Microsoft Quota)")
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Quota Control Value")
+	sid := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Query SID")
+	sid.Value = c.QuerySID
+	sid.Data.Write(c.QuerySID)
+	seq.AppendChild(sid)
+	p2.AppendChild(seq)
+
+	packet.AppendChild(p2)
+	return packet
+}
+
+func (c *ControlMicrosoftQuota) String() string {
+	return fmt.Sprintf(
+		"Control Type: %s (%q)  Criticality: %t  QuerySID: %x",
+		ControlTypeMap[ControlTypeMicrosoftQuota],
+		ControlTypeMicrosoftQuota,
+		false,
+		c.QuerySID)
+}
+
+func NewControlMicrosoftQuota(querySID []byte) *ControlMicrosoftQuota {
+	return &ControlMicrosoftQuota{QuerySID: querySID}
+}
+
 func FindControl(controls []Control, controlType string) Control {
 	for _, c := range controls {
 		if c.GetControlType() == controlType {
@@ -206,18 +330,130 @@ func FindControl(controls []Control, controlType string) Control {
 	return nil
 }
 
+// FindControls returns all controls of the given type, FindControl only
+// returns the first one.
+func FindControls(controls []Control, controlType string) []Control {
+	var found []Control
+	for _, c := range controls {
+		if c.GetControlType() == controlType {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+// PasswordStatus summarizes the password policy controls of a bind or
+// modify response, see PasswordStatusFromControls. ExpiresIn and
+// GraceRemaining are -1 if the server didn't send them.
+type PasswordStatus struct {
+	MustChange     bool
+	ExpiresIn      time.Duration
+	GraceRemaining int
+	Error          error
+}
+
+// PasswordStatusFromControls combines the Behera password policy control
+// and the older Netscape (VChu) password expired and expiring controls into
+// a PasswordStatus, so callers don't have to know which ones their server
+// sends. If both are present, the values of the Behera control take
+// precedence.
+func PasswordStatusFromControls(controls []Control) PasswordStatus {
+	status := PasswordStatus{ExpiresIn: -1, GraceRemaining: -1}
+
+	if c, ok := FindControl(controls, ControlTypeVChuPasswordWarning).(*ControlVChuPasswordWarning); ok && c.Expire >= 0 {
+		status.ExpiresIn = time.Duration(c.Expire) * time.Second
+	}
+	if c, ok := FindControl(controls, ControlTypeVChuPasswordMustChange).(*ControlVChuPasswordMustChange); ok {
+		status.MustChange = c.MustChange
+		if c.Expired {
+			status.Error = errors.New(BeheraPasswordPolicyErrorMap[BeheraPasswordExpired])
+		}
+	}
+
+	if c, ok := PasswordPolicyFromControls(controls); ok {
+		if c.Expire >= 0 {
+			status.ExpiresIn = time.Duration(c.Expire) * time.Second
+		}
+		if c.Grace >= 0 {
+			status.GraceRemaining = int(c.Grace)
+		}
+		if c.Error >= 0 {
+			status.Error = errors.New(c.ErrorString)
+			if c.Error == BeheraPasswordExpired || c.Error == BeheraChangeAfterReset {
+				status.MustChange = true
+			}
+		}
+	}
+	return status
+}
+
+// FilterUnknownControls removes the controls DecodeControl has no decoder
+// for (i.e. which are decoded as *ControlString) and aren't critical, e.g.
+// for a proxy which doesn't forward controls it doesn't understand. The
+// types of unknown critical controls are returned separately, the request
+// should be rejected with LDAPResultUnavailableCriticalExtension if there
+// are any.
+func FilterUnknownControls(controls []Control) (kept []Control, rejectedCritical []string) {
+	for _, c := range controls {
+		if unknown, ok := c.(*ControlString); ok {
+			if unknown.Criticality {
+				rejectedCritical = append(rejectedCritical, unknown.ControlType)
+			}
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return kept, rejectedCritical
+}
+
+// PasswordPolicyFromControls returns the password policy control from the
+// controls of a response, e.g. the PasswordModifyResult.Controls, to get the
+// expiry or grace logins left without looking through all controls.
+func PasswordPolicyFromControls(controls []Control) (*ControlBeheraPasswordPolicy, bool) {
+	c, ok := FindControl(controls, ControlTypeBeheraPasswordPolicy).(*ControlBeheraPasswordPolicy)
+	return c, ok
+}
+
 func DecodeControl(packet *ber.Packet) Control {
+	if !isControlPacket(packet) {
+		return nil
+	}
+	var value *ber.Packet
 	ControlType := packet.Children[0].Value.(string)
 	Criticality := false
+	if strings.TrimSpace(ControlType) == "" {
+		return nil
+	}
 
 	packet.Children[0].Description = "Control Type (" + ControlTypeMap[ControlType] + ")"
-	value := packet.Children[1]
-	if len(packet.Children) == 3 {
+	switch len(packet.Children) {
+	case 2:
+		// both criticality and value are optional, so the second child
+		// is either of them
+		if crit, ok := packet.Children[1].Value.(bool); ok {
+			packet.Children[1].Description = "Criticality"
+			Criticality = crit
+		} else {
+			value = packet.Children[1]
+		}
+	case 3:
 		value = packet.Children[2]
 		packet.Children[1].Description = "Criticality"
 		Criticality = packet.Children[1].Value.(bool)
 	}
 
+	if value == nil {
+		// a control without a value, e.g. the request form of the
+		// password policy control
+		switch ControlType {
+		case ControlTypeBeheraPasswordPolicy:
+			return NewControlBeheraPasswordPolicy()
+		case ControlTypeManageDsaIT:
+			return NewControlManageDsaIT(Criticality)
+		}
+		return NewControlString(ControlType, Criticality, "")
+	}
+
 	value.Description = "Control Value"
 	switch ControlType {
 	case ControlTypePaging:
@@ -225,56 +461,96 @@ func DecodeControl(packet *ber.Packet) Control {
 		c := new(ControlPaging)
 		if value.Value != nil {
 			valueChildren := ber.DecodePacket(value.Data.Bytes())
+			if valueChildren == nil {
+				return nil
+			}
 			value.Data.Truncate(0)
 			value.Value = nil
 			value.AppendChild(valueChildren)
 		}
-		value = value.Children[0]
+		if len(value.Children) == 0 {
+			return nil
+		}
+		value = unwrapControlValue(value.Children[0])
+		if value.Tag != ber.TagSequence || len(value.Children) != 2 {
+			return nil
+		}
+		pagingSize, ok := value.Children[0].Value.(int64)
+		if !ok {
+			return nil
+		}
 		value.Description = "Search Control Value"
 		value.Children[0].Description = "Paging Size"
 		value.Children[1].Description = "Cookie"
-		c.PagingSize = uint32(value.Children[0].Value.(int64))
+		c.PagingSize = uint32(pagingSize)
 		c.Cookie = value.Children[1].Data.Bytes()
-		value.Children[1].Value = c.Cookie
+		value.Children[1].Value = []byte(c.Cookie)
 		return c
 	case ControlTypeBeheraPasswordPolicy:
 		value.Description += " (Password Policy - Behera)"
 		c := NewControlBeheraPasswordPolicy()
 		if value.Value != nil {
 			valueChildren := ber.DecodePacket(value.Data.Bytes())
+			if valueChildren == nil {
+				return nil
+			}
 			value.Data.Truncate(0)
 			value.Value = nil
 			value.AppendChild(valueChildren)
 		}
+		if len(value.Children) == 0 {
+			return c
+		}
 
-		sequence := value.Children[0]
+		sequence := unwrapControlValue(value.Children[0])
+		// the response has an optional warning and an optional error
+		if sequence.ClassType != ber.ClassUniversal || sequence.Tag != ber.TagSequence || len(sequence.Children) > 2 {
+			return nil
+		}
 
+		// the value comes from the server, so don't trust its structure
+		// and skip anything we can't make sense of
 		for _, child := range sequence.Children {
+			if child.ClassType != ber.ClassContext {
+				continue
+			}
 			if child.Tag == 0 {
 				//Warning
+				if len(child.Children) == 0 {
+					continue
+				}
 				child := child.Children[0]
-				packet := ber.DecodePacket(child.Data.Bytes())
-				val, ok := packet.Value.(int64)
-				if ok {
-					if child.Tag == 0 {
-						//timeBeforeExpiration
-						c.Expire = val
-						child.Value = c.Expire
-					} else if child.Tag == 1 {
-						//graceAuthNsRemaining
-						c.Grace = val
-						child.Value = c.Grace
-					}
+				if child.ClassType != ber.ClassContext || child.TagType != ber.TypePrimitive {
+					continue
+				}
+				val, err := ber.ParseInt64(child.Data.Bytes())
+				if err != nil {
+					continue
+				}
+				if child.Tag == 0 {
+					//timeBeforeExpiration
+					c.Expire = val
+					child.Value = c.Expire
+				} else if child.Tag == 1 {
+					//graceAuthNsRemaining
+					c.Grace = val
+					child.Value = c.Grace
 				}
 			} else if child.Tag == 1 {
 				// Error
-				packet := ber.DecodePacket(child.Data.Bytes())
-				val, ok := packet.Value.(int8)
-				if !ok {
-					// what to do?
-					val = -1
+				if child.TagType != ber.TypePrimitive || child.Data.Len() == 0 {
+					continue
+				}
+				val, err := ber.ParseInt64(child.Data.Bytes())
+				if err != nil {
+					continue
+				}
+				if val < BeheraPasswordExpired || val > BeheraPasswordInHistory {
+					// not a known error, and it wouldn't fit into
+					// Error without wrapping around
+					return nil
 				}
-				c.Error = val
+				c.Error = int8(val)
 				child.Value = c.Error
 				c.ErrorString = BeheraPasswordPolicyErrorMap[c.Error]
 			}
@@ -282,10 +558,16 @@ func DecodeControl(packet *ber.Packet) Control {
 		return c
 	case ControlTypeVChuPasswordMustChange:
 		c := &ControlVChuPasswordMustChange{MustChange: true}
+		// "0" means the password has expired, anything else that it
+		// was reset and must be changed
+		mustChangeStr := ber.DecodeString(value.Data.Bytes())
+		c.Expired = strings.TrimSpace(strings.TrimRight(mustChangeStr, "\x00")) == "0"
 		return c
 	case ControlTypeVChuPasswordWarning:
 		c := &ControlVChuPasswordWarning{Expire: -1}
+		// some servers pad the value or send it NUL terminated
 		expireStr := ber.DecodeString(value.Data.Bytes())
+		expireStr = strings.TrimSpace(strings.TrimRight(expireStr, "\x00"))
 
 		expire, err := strconv.ParseInt(expireStr, 10, 64)
 		if err != nil {
@@ -295,14 +577,82 @@ func DecodeControl(packet *ber.Packet) Control {
 		value.Value = c.Expire
 
 		return c
+	case ControlTypeMicrosoftQuota:
+		value.Description += " (Microsoft Quota)"
+		c := new(ControlMicrosoftQuota)
+		if value.Value != nil {
+			valueChildren := ber.DecodePacket(value.Data.Bytes())
+			if valueChildren == nil {
+				return nil
+			}
+			value.Data.Truncate(0)
+			value.Value = nil
+			value.AppendChild(valueChildren)
+		}
+		if len(value.Children) == 0 {
+			return nil
+		}
+		sequence := unwrapControlValue(value.Children[0])
+		if sequence.ClassType != ber.ClassUniversal || sequence.Tag != ber.TagSequence || len(sequence.Children) != 1 {
+			return nil
+		}
+		sid := sequence.Children[0]
+		if sid.ClassType != ber.ClassUniversal || sid.TagType != ber.TypePrimitive || sid.Tag != ber.TagOctetString {
+			return nil
+		}
+		sequence.Description = "Quota Control Value"
+		sequence.Children[0].Description = "Query SID"
+		c.QuerySID = sequence.Children[0].Data.Bytes()
+		sequence.Children[0].Value = c.QuerySID
+		return c
+	}
+	// no decoder for this control, but we may still know its name
+	if name, ok := ControlTypeMap[ControlType]; ok {
+		value.Description += " (" + name + ")"
 	}
 	c := new(ControlString)
 	c.ControlType = ControlType
 	c.Criticality = Criticality
-	c.ControlValue = value.Value.(string)
+	controlValue, ok := value.Value.(string)
+	if !ok {
+		return nil
+	}
+	c.ControlValue = controlValue
 	return c
 }
 
+// DecodeControlReadOnly works like DecodeControl, but decodes a copy of the
+// packet, so the descriptions and values DecodeControl sets aren't written
+// back into the given packet, e.g. when it's shared between goroutines.
+// Returns nil if the packet can't be copied or decoded.
+func DecodeControlReadOnly(packet *ber.Packet) Control {
+	clone, err := ber.DecodePacketErr(packet.Bytes())
+	if err != nil {
+		return nil
+	}
+	return DecodeControl(clone)
+}
+
+// DecodeControlLenient decodes a control value which arrived without the
+// surrounding Control SEQUENCE, using the type and criticality known from
+// elsewhere. This is not standard LDAP, it's meant as a workaround for
+// servers sending broken controls; use DecodeControl otherwise. The value
+// may be the OCTET STRING of the control value or its bare contents.
+func DecodeControlLenient(value *ber.Packet, controlType string, criticality bool) Control {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, controlType, "Control Type ("+ControlTypeMap[controlType]+")"))
+	if criticality {
+		packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, criticality, "Criticality"))
+	}
+	if value != nil {
+		if value.ClassType != ber.ClassUniversal || value.TagType != ber.TypePrimitive || value.Tag != ber.TagOctetString {
+			value = ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(value.Bytes()), "Control Value")
+		}
+		packet.AppendChild(value)
+	}
+	return DecodeControl(packet)
+}
+
 func NewControlString(controlType string, criticality bool, controlValue string) *ControlString {
 	return &ControlString{
 		ControlType:  controlType,
@@ -315,6 +665,22 @@ func NewControlPaging(pagingSize uint32) *ControlPaging {
 	return &ControlPaging{PagingSize: pagingSize}
 }
 
+// NewControlPagingValidated returns a new paging control like
+// NewControlPaging, but fails for page sizes above math.MaxInt32. The
+// size is an INTEGER (0..maxInt) on the wire, so larger values are
+// rejected by most servers with a rather confusing protocol error.
+func NewControlPagingValidated(pagingSize uint32) (*ControlPaging, error) {
+	if pagingSize > math.MaxInt32 {
+		return nil, fmt.Errorf("ldap: paging size %d exceeds the maximum of %d", pagingSize, math.MaxInt32)
+	}
+	return NewControlPaging(pagingSize), nil
+}
+
+// NewControlBeheraPasswordPolicy returns the request form of the password
+// policy control, i.e. without value and not critical. Send it with a bind
+// to get the expiry warnings or the reason for a failed bind. Don't make
+// it critical, a server without ppolicy would then reject the bind instead
+// of just ignoring the control.
 func NewControlBeheraPasswordPolicy() *ControlBeheraPasswordPolicy {
 	return &ControlBeheraPasswordPolicy{
 		Expire: -1,
@@ -323,10 +689,220 @@ func NewControlBeheraPasswordPolicy() *ControlBeheraPasswordPolicy {
 	}
 }
 
-func encodeControls(controls []Control) *ber.Packet {
+// EncodeControls returns the controls wrapper of an LDAP message containing
+// the given controls. Controls which can only be received from the server
+// (i.e. their Encode() returns nil) are skipped.
+func EncodeControls(controls []Control) *ber.Packet {
 	packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
 	for _, control := range controls {
-		packet.AppendChild(control.Encode())
+		if encoded := control.Encode(); encoded != nil {
+			packet.AppendChild(encoded)
+		}
+	}
+	return packet
+}
+
+// EncodeControlExplicitCriticality encodes the control like its Encode()
+// method, but always includes the criticality, i.e. also an explicit FALSE
+// which is usually omitted as it's the default. Some strict servers reject
+// controls without it. Returns nil if the control can't be encoded.
+func EncodeControlExplicitCriticality(control Control) *ber.Packet {
+	encoded := control.Encode()
+	if encoded == nil || len(encoded.Children) == 0 {
+		return encoded
+	}
+	if len(encoded.Children) > 1 {
+		if _, ok := encoded.Children[1].Value.(bool); ok {
+			return encoded
+		}
+	}
+	packet := ber.Encode(encoded.ClassType, encoded.TagType, encoded.Tag, nil, encoded.Description)
+	packet.AppendChild(encoded.Children[0])
+	packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Criticality"))
+	for _, child := range encoded.Children[1:] {
+		packet.AppendChild(child)
+	}
+	return packet
+}
+
+// MarshalControl returns the BER encoding of the control. An error is
+// returned for controls which can't be encoded, i.e. whose Encode()
+// returns nil as they are only sent by the server.
+func MarshalControl(control Control) ([]byte, error) {
+	packet := control.Encode()
+	if packet == nil {
+		return nil, fmt.Errorf("ldap: control %s can't be encoded", control.GetControlType())
+	}
+	return packet.Bytes(), nil
+}
+
+// UnmarshalControl decodes a control from its BER encoding, as returned
+// by MarshalControl.
+func UnmarshalControl(data []byte) (Control, error) {
+	packet, err := ber.DecodePacketErr(data)
+	if err != nil {
+		return nil, err
+	}
+	control := DecodeControl(packet)
+	if control == nil {
+		return nil, errors.New("ldap: invalid control data")
+	}
+	return control, nil
+}
+
+// isControlPacket checks the structure DecodeControl relies on, i.e. a
+// SEQUENCE with the control type and optional criticality and OCTET STRING
+// value.
+func isControlPacket(packet *ber.Packet) bool {
+	if packet.ClassType != ber.ClassUniversal || packet.Tag != ber.TagSequence || len(packet.Children) == 0 || len(packet.Children) > 3 {
+		return false
+	}
+	if _, ok := packet.Children[0].Value.(string); !ok {
+		return false
+	}
+	if len(packet.Children) == 3 {
+		if _, ok := packet.Children[1].Value.(bool); !ok {
+			return false
+		}
+	}
+	if len(packet.Children) > 1 {
+		// the value, if present, is the last child, unless that's the
+		// criticality
+		value := packet.Children[len(packet.Children)-1]
+		if _, ok := value.Value.(bool); ok && len(packet.Children) == 2 {
+			return true
+		}
+		if value.ClassType != ber.ClassUniversal || value.TagType != ber.TypePrimitive || value.Tag != ber.TagOctetString {
+			return false
+		}
+	}
+	return true
+}
+
+// ControlExplicitCriticality wraps a control to encode it with
+// EncodeControlExplicitCriticality wherever controls are sent, e.g. pass
+// NewControlExplicitCriticality(NewControlPaging(100)) in the controls of a
+// search request for a server which requires the criticality.
+type ControlExplicitCriticality struct {
+	Control
+}
+
+func (c *ControlExplicitCriticality) Encode() *ber.Packet {
+	return EncodeControlExplicitCriticality(c.Control)
+}
+
+func NewControlExplicitCriticality(control Control) *ControlExplicitCriticality {
+	return &ControlExplicitCriticality{Control: control}
+}
+
+// HexDumpControlValue returns a hex dump of the value of the given control
+// packet, e.g. to report a control that fails to decode. An empty string
+// is returned if the control has no value.
+func HexDumpControlValue(packet *ber.Packet) string {
+	if len(packet.Children) < 2 {
+		return ""
+	}
+	for _, child := range packet.Children[1:] {
+		if _, ok := child.Value.(bool); !ok {
+			return enchex.Dump(child.Data.Bytes())
+		}
+	}
+	return ""
+}
+
+// WrapRawControls returns a controls wrapper like EncodeControls, but for
+// already encoded controls, e.g. captured from another connection. The
+// controls are copied verbatim, so the wrapper has no child packets and
+// must be serialized with Bytes() to be decoded again.
+func WrapRawControls(rawControls [][]byte) *ber.Packet {
+	packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+	for _, raw := range rawControls {
+		packet.Data.Write(raw)
 	}
 	return packet
 }
+
+// MaxControlChildren limits the number of controls accepted in a response,
+// a response with more controls is most likely from a broken or malicious
+// server and is rejected before the controls are decoded with
+// DecodeControl. It doesn't limit the memory used for the response, the
+// BER packet has already been read and parsed at that point.
+var MaxControlChildren = 1000
+
+// LenientControlDecoding makes DecodeControl accept control values wrapped
+// in a redundant OCTET STRING, i.e. OCTET STRING { OCTET STRING { value } },
+// as sent by some broken servers. Such values are rejected by default.
+var LenientControlDecoding = false
+
+// unwrapControlValue returns the contents of a redundant OCTET STRING
+// wrapping the decoded control value if LenientControlDecoding is set, the
+// value itself otherwise.
+func unwrapControlValue(value *ber.Packet) *ber.Packet {
+	if !LenientControlDecoding || value.ClassType != ber.ClassUniversal || value.TagType != ber.TypePrimitive || value.Tag != ber.TagOctetString {
+		return value
+	}
+	if inner := ber.DecodePacket(value.Data.Bytes()); inner != nil {
+		return inner
+	}
+	return value
+}
+
+func decodeControls(packet *ber.Packet) ([]Control, error) {
+	if len(packet.Children) > MaxControlChildren {
+		return nil, NewError(ErrorUnexpectedResponse, fmt.Errorf("ldap: too many controls (%d > %d)", len(packet.Children), MaxControlChildren))
+	}
+	controls := make([]Control, 0, len(packet.Children))
+	for _, child := range packet.Children {
+		control := DecodeControl(child)
+		if control == nil {
+			control = rawControl(child)
+		}
+		if control != nil {
+			controls = append(controls, control)
+		}
+	}
+	return controls, nil
+}
+
+// rawControl returns a control DecodeControl couldn't make sense of as a
+// ControlString with the undecoded value, or nil if it has no usable type.
+func rawControl(packet *ber.Packet) Control {
+	if !isControlPacket(packet) {
+		return nil
+	}
+	controlType := packet.Children[0].Value.(string)
+	if strings.TrimSpace(controlType) == "" {
+		return nil
+	}
+	c := &ControlString{ControlType: controlType}
+	for _, child := range packet.Children[1:] {
+		if criticality, ok := child.Value.(bool); ok {
+			c.Criticality = criticality
+			continue
+		}
+		c.ControlValue = string(child.Data.Bytes())
+	}
+	return c
+}
+
+// DecodeResponseControls decodes the controls of an LDAP response message,
+// i.e. the optional "[0] Controls" element following the protocol operation.
+// An empty slice is returned if the response carries no controls. Each
+// control is decoded on its own: malformed ones are skipped and those with a
+// value DecodeControl rejects are returned as a ControlString holding the raw
+// value. An error is only returned if the wrapper itself is malformed or
+// holds more than MaxControlChildren controls.
+func DecodeResponseControls(packet *ber.Packet) ([]Control, error) {
+	if len(packet.Children) > 2 {
+		for _, child := range packet.Children[2:] {
+			if child.ClassType != ber.ClassContext {
+				continue
+			}
+			if child.Tag != 0 || child.TagType != ber.TypeConstructed {
+				return nil, NewError(ErrorUnexpectedResponse, fmt.Errorf("ldap: invalid controls wrapper (tag %d)", child.Tag))
+			}
+			return decodeControls(child)
+		}
+	}
+	return []Control{}, nil
+}
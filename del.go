@@ -36,7 +36,7 @@ func (l *Conn) Del(delRequest *DelRequest) error {
 	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, l.nextMessageID(), "MessageID"))
 	packet.AppendChild(delRequest.encode())
 	if delRequest.Controls != nil {
-		packet.AppendChild(encodeControls(delRequest.Controls))
+		packet.AppendChild(EncodeControls(delRequest.Controls))
 	}
 
 	l.Debug.PrintPacket(packet)
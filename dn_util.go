@@ -26,6 +26,76 @@ func (dn *DN) String() string {
 	return strings.Join(rdns, ",")
 }
 
+// Returns the DN in a normalized form suitable for comparing DNs as strings,
+// e.g. DNs returned by different servers. Attribute types are lower cased
+// and unescaped spaces around types and values are removed, e.g.
+//
+//  ldap.NormalizeDN("CN=Someone , OU=People,dc=example, DC=org")
+//   -> "cn=Someone,ou=People,dc=example,dc=org"
+//
+// Note: the values keep their case, use DN.Equal() to compare them case
+// insensitively.
+func NormalizeDN(str string) (string, error) {
+	dn, err := ParseDN(trimDNSpaces(str))
+	if err != nil {
+		return "", err
+	}
+	var rdns []string
+	for _, r := range dn.RDNs {
+		var tv []string
+		for _, av := range r.Attributes {
+			// spaces at the start or end of the value must stay
+			// escaped
+			value := EscapeValue(av.Value)
+			if strings.HasPrefix(av.Value, " ") {
+				value = "\\" + value
+			}
+			if len(av.Value) > 1 && strings.HasSuffix(av.Value, " ") {
+				value = value[:len(value)-1] + "\\ "
+			}
+			tv = append(tv, strings.ToLower(av.Type)+"="+value)
+		}
+		rdns = append(rdns, strings.Join(tv, "+"))
+	}
+	return strings.Join(rdns, ","), nil
+}
+
+// removes the spaces around the separators of a DN string, which ParseDN
+// would keep as part of the types and values, spaces escaped with a
+// backslash are kept
+func trimDNSpaces(str string) string {
+	buf := make([]byte, 0, len(str))
+	spaces := 0
+	separator := true
+	inValue := false
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		switch {
+		case c == '\\' && i+1 < len(str):
+			buf = append(buf, strings.Repeat(" ", spaces)...)
+			buf = append(buf, c, str[i+1])
+			spaces = 0
+			separator = false
+			i++
+		case c == ' ':
+			if !separator {
+				spaces++
+			}
+		case c == ',' || c == '+' || (c == '=' && !inValue):
+			buf = append(buf, c)
+			spaces = 0
+			separator = true
+			inValue = c == '='
+		default:
+			buf = append(buf, strings.Repeat(" ", spaces)...)
+			buf = append(buf, c)
+			spaces = 0
+			separator = false
+		}
+	}
+	return string(buf)
+}
+
 func EscapeValue(value string) (escaped string) {
 	for _, r := range value {
 		switch r {
@@ -91,3 +91,41 @@ func TestDNSort(t *testing.T) {
 		t.Errorf("DN uid=another,ou=people,dc=example,dc=org is not first")
 	}
 }
+
+func TestNormalizeDN(t *testing.T) {
+	expected := "cn=Someone,ou=People,dc=example,dc=org"
+	for _, s := range []string{
+		"cn=Someone,ou=People,dc=example,dc=org",
+		"CN=Someone,OU=People,DC=example,DC=org",
+		"cn=Someone, ou=People, dc=example, dc=org",
+		" Cn = Someone ,Ou=People , dc=example,  DC=org ",
+	} {
+		dn, err := ldap.NormalizeDN(s)
+		if err != nil {
+			t.Errorf("failed to normalize %q: %s", s, err)
+		} else if dn != expected {
+			t.Errorf("%q: expected %q, got %q", s, expected, dn)
+		}
+	}
+
+	// escaped spaces are part of the value
+	for s, expected := range map[string]string{
+		`cn=foo\ ,dc=org`:       `cn=foo\ ,dc=org`,
+		`cn=\ foo,dc=org`:       `cn=\ foo,dc=org`,
+		`CN = \ foo\  , DC=org`: `cn=\ foo\ ,dc=org`,
+		`cn=\ ,dc=org`:          `cn=\ ,dc=org`,
+		`cn=foo\20,dc=org`:      `cn=foo\ ,dc=org`,
+		`cn=foo bar , dc=org`:   `cn=foo bar,dc=org`,
+	} {
+		dn, err := ldap.NormalizeDN(s)
+		if err != nil {
+			t.Errorf("failed to normalize %q: %s", s, err)
+		} else if dn != expected {
+			t.Errorf("%q: expected %q, got %q", s, expected, dn)
+		}
+	}
+
+	if _, err := ldap.NormalizeDN("cn=Someone,dc"); err == nil {
+		t.Errorf("expected error for invalid DN")
+	}
+}
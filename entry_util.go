@@ -0,0 +1,338 @@
+package ldap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Seconds between the start of the FILETIME epoch (1601-01-01) and the
+// unix epoch
+const fileTimeEpochOffset = 11644473600
+
+// FileTimeNever is returned by GetAttributeFileTime for the largest
+// FILETIME value, which AD uses e.g. for accounts that never expire.
+var FileTimeNever = fileTimeToTime(math.MaxInt64)
+
+// Layouts of the GeneralizedTime (RFC 4517) and the obsolete UTCTime syntax
+// by the number of digits before the fraction or time zone, in the order
+// they're tried. GeneralizedTime may omit the minutes and seconds and have
+// an offset without minutes, UTCTime may omit the seconds, so 12 and 10
+// digits are ambiguous. 12 digits are the usual UTCTime form and tried as
+// such first, 10 digits as GeneralizedTime. Fractions of a second are
+// accepted by time.Parse even if they're not part of the layout.
+var timeLayouts = map[int][]string{
+	14: {"20060102150405Z0700", "20060102150405Z07"},
+	12: {"060102150405Z0700", "200601021504Z0700", "200601021504Z07"},
+	10: {"2006010215Z0700", "2006010215Z07", "0601021504Z0700"},
+}
+
+// returns the attribute with the given name, the name is compared case
+// insensitively as attribute descriptions are case insensitive
+func (e *Entry) getAttributeFold(attribute string) *EntryAttribute {
+	for _, attr := range e.Attributes {
+		if strings.EqualFold(attr.Name, attribute) {
+			return attr
+		}
+	}
+	return nil
+}
+
+// NewEntryDedup returns an Entry like NewEntry, but removes duplicate values
+// of each attribute. Values are compared case sensitively and the order of
+// the remaining values is kept.
+func NewEntryDedup(dn string, attributes map[string][]string) *Entry {
+	deduped := make(map[string][]string, len(attributes))
+	for name, values := range attributes {
+		seen := make(map[string]bool, len(values))
+		unique := make([]string, 0, len(values))
+		for _, value := range values {
+			if !seen[value] {
+				seen[value] = true
+				unique = append(unique, value)
+			}
+		}
+		deduped[name] = unique
+	}
+	return NewEntry(dn, deduped)
+}
+
+// MergePages concatenates the entries of several pages of a paged search
+// into a single slice.
+func MergePages(pages ...[]*Entry) []*Entry {
+	var entries []*Entry
+	for _, page := range pages {
+		entries = append(entries, page...)
+	}
+	return entries
+}
+
+// MergePagesDedup works like MergePages, but only keeps the first entry for
+// each DN. DNs are normalized with NormalizeDN and compared case
+// insensitively; DNs which can't be parsed are only compared case
+// insensitively.
+func MergePagesDedup(pages ...[]*Entry) []*Entry {
+	var entries []*Entry
+	seen := make(map[string]bool)
+	for _, page := range pages {
+		for _, entry := range page {
+			dn := entry.DN
+			if normalized, err := NormalizeDN(dn); err == nil {
+				dn = normalized
+			}
+			dn = strings.ToLower(dn)
+			if !seen[dn] {
+				seen[dn] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+// Clone returns a deep copy of the entry, modifying the attributes or values
+// of the copy doesn't change the original entry and vice versa.
+func (e *Entry) Clone() *Entry {
+	clone := &Entry{DN: e.DN}
+	if e.Attributes != nil {
+		clone.Attributes = make([]*EntryAttribute, len(e.Attributes))
+		for i, attr := range e.Attributes {
+			clone.Attributes[i] = attr.Clone()
+		}
+	}
+	return clone
+}
+
+// Clone returns a deep copy of the attribute including its byte values.
+func (e *EntryAttribute) Clone() *EntryAttribute {
+	clone := &EntryAttribute{Name: e.Name}
+	if e.Values != nil {
+		clone.Values = make([]string, len(e.Values))
+		copy(clone.Values, e.Values)
+	}
+	if e.ByteValues != nil {
+		clone.ByteValues = make([][]byte, len(e.ByteValues))
+		for i, value := range e.ByteValues {
+			if value != nil {
+				clone.ByteValues[i] = append([]byte{}, value...)
+			}
+		}
+	}
+	return clone
+}
+
+// AttributeMap returns a copy of the entry's attribute values keyed by the
+// lower cased attribute names. Values of attributes whose names differ only
+// in case are merged.
+func (e *Entry) AttributeMap() map[string][]string {
+	attributes := make(map[string][]string, len(e.Attributes))
+	for _, attr := range e.Attributes {
+		name := strings.ToLower(attr.Name)
+		attributes[name] = append(attributes[name], attr.Values...)
+	}
+	return attributes
+}
+
+// HasObjectClass returns whether the class is one of the values of the
+// entry's objectClass attribute. Class names are compared case
+// insensitively.
+func (e *Entry) HasObjectClass(class string) bool {
+	attr := e.getAttributeFold("objectClass")
+	if attr == nil {
+		return false
+	}
+	for _, value := range attr.Values {
+		if strings.EqualFold(value, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first value of the language tagged subtype of the attribute,
+// e.g. "description;lang-de" for GetAttributeValueLang("description",
+// "de"). If there's no such subtype the value of the attribute itself is
+// returned, or an empty string if neither exists. Attribute names and
+// options are case insensitive.
+func (e *Entry) GetAttributeValueLang(attribute string, lang string) string {
+	tag := "lang-" + lang
+	for _, attr := range e.Attributes {
+		options := strings.Split(attr.Name, ";")
+		if len(options) < 2 || !strings.EqualFold(options[0], attribute) || len(attr.Values) == 0 {
+			continue
+		}
+		for _, option := range options[1:] {
+			if strings.EqualFold(option, tag) {
+				return attr.Values[0]
+			}
+		}
+	}
+	if attr := e.getAttributeFold(attribute); attr != nil && len(attr.Values) > 0 {
+		return attr.Values[0]
+	}
+	return ""
+}
+
+// Returns the first value of the attribute parsed as GeneralizedTime, e.g.
+// "20240101123000.0Z" for whenCreated. Values in the older UTCTime
+// syntax like "240101123000Z" are accepted as well. The attribute name is
+// case insensitive.
+func (e *Entry) GetAttributeTime(attribute string) (time.Time, error) {
+	attr := e.getAttributeFold(attribute)
+	if attr == nil || len(attr.Values) == 0 {
+		return time.Time{}, fmt.Errorf("ldap: no value for attribute %s", attribute)
+	}
+	value := attr.Values[0]
+	digits := 0
+	for digits < len(value) && value[digits] >= '0' && value[digits] <= '9' {
+		digits++
+	}
+	for _, layout := range timeLayouts[digits] {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("ldap: invalid time %q in attribute %s", value, attribute)
+}
+
+func fileTimeToTime(ft int64) time.Time {
+	return time.Unix(ft/1e7-fileTimeEpochOffset, (ft%1e7)*100).UTC()
+}
+
+// Returns the first value of the attribute as time, the value is an AD
+// FILETIME integer like pwdLastSet, accountExpires or lastLogonTimestamp,
+// i.e. the number of 100 nanosecond intervals since 1601-01-01 UTC. The
+// attribute name is case insensitive.
+//
+// A value of 0 (e.g. "must change password" for pwdLastSet) is returned as
+// zero time.Time, 0x7FFFFFFFFFFFFFFF ("never expires") as FileTimeNever.
+func (e *Entry) GetAttributeFileTime(attribute string) (time.Time, error) {
+	attr := e.getAttributeFold(attribute)
+	if attr == nil || len(attr.Values) == 0 {
+		return time.Time{}, fmt.Errorf("ldap: no value for attribute %s", attribute)
+	}
+	ft, err := strconv.ParseInt(attr.Values[0], 10, 64)
+	if err != nil || ft < 0 {
+		return time.Time{}, fmt.Errorf("ldap: invalid FILETIME %q in attribute %s", attr.Values[0], attribute)
+	}
+	switch ft {
+	case 0:
+		return time.Time{}, nil
+	case math.MaxInt64:
+		return FileTimeNever, nil
+	}
+	return fileTimeToTime(ft), nil
+}
+
+// ParseSID returns the string form (e.g. "S-1-5-21-...") of a binary
+// security identifier as found in AD's objectSid attribute.
+func ParseSID(b []byte) (string, error) {
+	if len(b) < 8 {
+		return "", fmt.Errorf("ldap: SID too short: %d bytes", len(b))
+	}
+	count := int(b[1])
+	if count > 15 {
+		return "", fmt.Errorf("ldap: invalid SID sub-authority count %d", count)
+	}
+	if len(b) != 8+4*count {
+		return "", fmt.Errorf("ldap: invalid SID length %d for %d sub-authorities", len(b), count)
+	}
+	var authority uint64
+	for _, c := range b[2:8] {
+		authority = authority<<8 | uint64(c)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "S-%d-%d", b[0], authority)
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&buf, "-%d", binary.LittleEndian.Uint32(b[8+4*i:]))
+	}
+	return buf.String(), nil
+}
+
+// Returns the first value of the attribute (e.g. objectSid) as SID string,
+// see ParseSID
+func (e *Entry) GetAttributeSID(attribute string) (string, error) {
+	return ParseSID(e.GetRawAttributeValue(attribute))
+}
+
+// ParseGUID returns the string form (e.g.
+// "0fe2d2ee-8e6b-4b35-a54e-17bcc4a2a0fd") of a binary GUID as found in AD's
+// objectGUID attribute. The first three fields are stored little endian,
+// the last two big endian.
+func ParseGUID(b []byte) (string, error) {
+	if len(b) != 16 {
+		return "", fmt.Errorf("ldap: invalid GUID length %d", len(b))
+	}
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10],
+		b[10:16],
+	), nil
+}
+
+// Returns the first value of the attribute (e.g. objectGUID) as GUID
+// string, see ParseGUID
+func (e *Entry) GetAttributeGUID(attribute string) (string, error) {
+	return ParseGUID(e.GetRawAttributeValue(attribute))
+}
+
+// EffectiveRights are the access rights of the bound user (or the one
+// requested with the Get Effective Rights control) on an entry, as returned
+// in the aclRights operational attribute. The rights are keyed by their
+// names, e.g. "add", "delete" or "read" on the entry level and "read",
+// "write" or "selfwrite_add" for attributes. Attributes are keyed by their
+// lower cased names.
+type EffectiveRights struct {
+	Entry      map[string]bool
+	Attributes map[string]map[string]bool
+}
+
+// ParseEffectiveRights parses the aclRights;entryLevel and
+// aclRights;attributeLevel;<attribute> values of the entry, e.g.
+// "add:0,delete:0,read:1,write:0,proxy:0".
+func ParseEffectiveRights(e *Entry) (EffectiveRights, error) {
+	rights := EffectiveRights{
+		Entry:      map[string]bool{},
+		Attributes: map[string]map[string]bool{},
+	}
+	found := false
+	for _, attr := range e.Attributes {
+		options := strings.Split(attr.Name, ";")
+		if !strings.EqualFold(options[0], "aclRights") || len(attr.Values) == 0 {
+			continue
+		}
+		var target map[string]bool
+		switch {
+		case len(options) == 2 && strings.EqualFold(options[1], "entryLevel"):
+			target = rights.Entry
+		case len(options) == 3 && strings.EqualFold(options[1], "attributeLevel"):
+			name := strings.ToLower(options[2])
+			if rights.Attributes[name] == nil {
+				rights.Attributes[name] = map[string]bool{}
+			}
+			target = rights.Attributes[name]
+		default:
+			return rights, fmt.Errorf("ldap: unknown effective rights attribute %s", attr.Name)
+		}
+		found = true
+		for _, value := range attr.Values {
+			for _, right := range strings.Split(value, ",") {
+				parts := strings.Split(strings.TrimSpace(right), ":")
+				if len(parts) != 2 || parts[0] == "" || (parts[1] != "0" && parts[1] != "1") {
+					return rights, fmt.Errorf("ldap: invalid effective right %q in attribute %s", right, attr.Name)
+				}
+				target[parts[0]] = parts[1] == "1"
+			}
+		}
+	}
+	if !found {
+		return rights, fmt.Errorf("ldap: no effective rights in entry %s", e.DN)
+	}
+	return rights, nil
+}
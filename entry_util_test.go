@@ -0,0 +1,341 @@
+package ldap_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/ldap.v2"
+)
+
+func TestNewEntryDedup(t *testing.T) {
+	entry := ldap.NewEntryDedup("cn=test,dc=example,dc=org", map[string][]string{
+		"cn":          {"test"},
+		"mail":        {"b@example.org", "a@example.org", "b@example.org", "B@example.org", "a@example.org"},
+		"objectClass": {"top", "person", "top"},
+	})
+	expected := ldap.NewEntry("cn=test,dc=example,dc=org", map[string][]string{
+		"cn":          {"test"},
+		"mail":        {"b@example.org", "a@example.org", "B@example.org"},
+		"objectClass": {"top", "person"},
+	})
+	if !reflect.DeepEqual(entry, expected) {
+		t.Errorf("expected %v, got %v", expected, entry)
+	}
+}
+
+func TestMergePages(t *testing.T) {
+	alice := ldap.NewEntry("uid=alice,ou=people,dc=example,dc=org", nil)
+	bob := ldap.NewEntry("uid=bob,ou=people,dc=example,dc=org", nil)
+	bobAgain := ldap.NewEntry("UID=Bob,OU=People,DC=example,DC=org", nil)
+	bobSpaces := ldap.NewEntry("uid=bob, ou=people, dc=example,dc=org", nil)
+	carol := ldap.NewEntry("uid=carol,ou=people,dc=example,dc=org", nil)
+	invalid := ldap.NewEntry("invalid", nil)
+	invalidAgain := ldap.NewEntry("INVALID", nil)
+	pages := [][]*ldap.Entry{{alice, bob}, {}, {bobAgain, bobSpaces, carol}, {invalid, invalidAgain}}
+
+	if entries := ldap.MergePages(pages...); !reflect.DeepEqual(entries, []*ldap.Entry{alice, bob, bobAgain, bobSpaces, carol, invalid, invalidAgain}) {
+		t.Errorf("MergePages: unexpected entries %v", entries)
+	}
+	if entries := ldap.MergePagesDedup(pages...); !reflect.DeepEqual(entries, []*ldap.Entry{alice, bob, carol, invalid}) {
+		t.Errorf("MergePagesDedup: unexpected entries %v", entries)
+	}
+	if entries := ldap.MergePages(); entries != nil {
+		t.Errorf("MergePages: expected nil for no pages, got %v", entries)
+	}
+}
+
+func TestEntryClone(t *testing.T) {
+	entry := ldap.NewEntry("cn=test,dc=example,dc=org", map[string][]string{
+		"cn":          {"test"},
+		"objectClass": {"top", "person"},
+		"objectGUID":  {string([]byte{0x00, 0x01, 0xfe, 0xff})},
+	})
+	original := ldap.NewEntry("cn=test,dc=example,dc=org", map[string][]string{
+		"cn":          {"test"},
+		"objectClass": {"top", "person"},
+		"objectGUID":  {string([]byte{0x00, 0x01, 0xfe, 0xff})},
+	})
+
+	clone := entry.Clone()
+	if !reflect.DeepEqual(clone, entry) {
+		t.Fatalf("clone differs from entry: %v", clone)
+	}
+
+	clone.DN = "cn=clone,dc=example,dc=org"
+	clone.Attributes[0].Values[0] = "clone"
+	clone.Attributes[1].Values = append(clone.Attributes[1].Values, "inetOrgPerson")
+	clone.Attributes[2].ByteValues[0][0] = 0x42
+	clone.Attributes = append(clone.Attributes, ldap.NewEntryAttribute("sn", []string{"clone"}))
+
+	if !reflect.DeepEqual(entry, original) {
+		t.Errorf("modifying the clone changed the entry")
+	}
+}
+
+func TestEntryAttributeMap(t *testing.T) {
+	entry := ldap.NewEntry("cn=test,dc=example,dc=org", map[string][]string{
+		"cn":   {"test"},
+		"Mail": {"a@example.org"},
+		"mail": {"b@example.org", "c@example.org"},
+	})
+	expected := map[string][]string{
+		"cn":   {"test"},
+		"mail": {"a@example.org", "b@example.org", "c@example.org"},
+	}
+
+	attributes := entry.AttributeMap()
+	if !reflect.DeepEqual(attributes, expected) {
+		t.Errorf("expected %v, got %v", expected, attributes)
+	}
+
+	attributes["cn"][0] = "changed"
+	if entry.GetAttributeValue("cn") != "test" {
+		t.Errorf("modifying the map changed the entry")
+	}
+}
+
+func TestEntryHasObjectClass(t *testing.T) {
+	entry := ldap.NewEntry("cn=test,dc=example,dc=org", map[string][]string{
+		"objectclass": {"top", "inetOrgPerson"},
+	})
+	for _, class := range []string{"top", "inetOrgPerson", "INETORGPERSON"} {
+		if !entry.HasObjectClass(class) {
+			t.Errorf("%s: expected object class", class)
+		}
+	}
+	for _, class := range []string{"person", "inetOrg", ""} {
+		if entry.HasObjectClass(class) {
+			t.Errorf("%s: unexpected object class", class)
+		}
+	}
+	if ldap.NewEntry("cn=test,dc=example,dc=org", nil).HasObjectClass("top") {
+		t.Errorf("unexpected object class for entry without objectClass")
+	}
+}
+
+func TestEntryGetAttributeValueLang(t *testing.T) {
+	entry := ldap.NewEntry("cn=test,dc=example,dc=org", map[string][]string{
+		"description":                {"Printer"},
+		"description;lang-de":        {"Drucker"},
+		"description;binary;LANG-FR": {"Imprimante"},
+		"cn;lang-de":                 {},
+	})
+	var tests = []struct {
+		attribute string
+		lang      string
+		expected  string
+	}{
+		{"description", "de", "Drucker"},
+		{"Description", "DE", "Drucker"},
+		{"description", "fr", "Imprimante"},
+		{"description", "en", "Printer"},
+		{"cn", "de", ""},
+		{"sn", "de", ""},
+	}
+	for _, test := range tests {
+		if value := entry.GetAttributeValueLang(test.attribute, test.lang); value != test.expected {
+			t.Errorf("%s;lang-%s: expected %q, got %q", test.attribute, test.lang, test.expected, value)
+		}
+	}
+}
+
+func TestEntryGetAttributeTime(t *testing.T) {
+	entry := ldap.NewEntry("cn=test,dc=example,dc=org", map[string][]string{
+		"whenCreated":     {"20240101123000.0Z"},
+		"whenChanged":     {"20240101123000Z"},
+		"createTimestamp": {"20240101123000.123+0200"},
+		"modifyTimestamp": {"240101123000Z"},
+		"pwdChangedTime":  {"yesterday"},
+		"utcTime":         {"240101120000Z"},
+		"utcTimeMinutes":  {"9912311200+0100"},
+		"minutes":         {"202401011230Z"},
+		"hours":           {"2024010112Z"},
+		"hourOffset":      {"20240101123000+02"},
+		"shortTime":       {"20240101Z"},
+	})
+	expected := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+
+	for _, attribute := range []string{"whenCreated", "WHENCREATED", "whenChanged", "modifyTimestamp"} {
+		value, err := entry.GetAttributeTime(attribute)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", attribute, err)
+		} else if !value.Equal(expected) {
+			t.Errorf("%s: expected %s, got %s", attribute, expected, value)
+		}
+	}
+
+	value, err := entry.GetAttributeTime("createTimestamp")
+	expected = time.Date(2024, 1, 1, 10, 30, 0, 123000000, time.UTC)
+	if err != nil {
+		t.Errorf("createTimestamp: unexpected error: %s", err)
+	} else if !value.Equal(expected) {
+		t.Errorf("createTimestamp: expected %s, got %s", expected, value)
+	}
+
+	// 12 digits are UTCTime unless that's invalid, 10 digits GeneralizedTime
+	for attribute, expected := range map[string]time.Time{
+		"utcTime":        time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		"utcTimeMinutes": time.Date(1999, 12, 31, 11, 0, 0, 0, time.UTC),
+		"minutes":        time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC),
+		"hours":          time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		"hourOffset":     time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC),
+	} {
+		value, err := entry.GetAttributeTime(attribute)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", attribute, err)
+		} else if !value.Equal(expected) {
+			t.Errorf("%s: expected %s, got %s", attribute, expected, value)
+		}
+	}
+
+	if _, err := entry.GetAttributeTime("shortTime"); err == nil {
+		t.Errorf("expected error for too short time")
+	}
+	if _, err := entry.GetAttributeTime("pwdChangedTime"); err == nil {
+		t.Errorf("expected error for invalid time")
+	}
+	if _, err := entry.GetAttributeTime("description"); err == nil {
+		t.Errorf("expected error for missing attribute")
+	}
+}
+
+func TestEntryGetAttributeFileTime(t *testing.T) {
+	entry := ldap.NewEntry("cn=test,dc=example,dc=org", map[string][]string{
+		"pwdLastSet":         {"0"},
+		"accountExpires":     {"9223372036854775807"},
+		"lastLogonTimestamp": {"133485858000000000"},
+		"badPasswordTime":    {"-1"},
+		"lockoutTime":        {"never"},
+	})
+
+	value, err := entry.GetAttributeFileTime("lastLogonTimestamp")
+	expected := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if !value.Equal(expected) {
+		t.Errorf("expected %s, got %s", expected, value)
+	}
+
+	value, err = entry.GetAttributeFileTime("PwdLastSet")
+	if err != nil {
+		t.Errorf("zero: unexpected error: %s", err)
+	} else if !value.IsZero() {
+		t.Errorf("zero: expected zero time, got %s", value)
+	}
+
+	value, err = entry.GetAttributeFileTime("accountExpires")
+	if err != nil {
+		t.Errorf("never: unexpected error: %s", err)
+	} else if !value.Equal(ldap.FileTimeNever) {
+		t.Errorf("never: expected %s, got %s", ldap.FileTimeNever, value)
+	}
+
+	for _, attribute := range []string{"badPasswordTime", "lockoutTime", "description"} {
+		if _, err := entry.GetAttributeFileTime(attribute); err == nil {
+			t.Errorf("%s: expected error", attribute)
+		}
+	}
+}
+
+func TestParseSID(t *testing.T) {
+	var tests = []struct {
+		sid      []byte
+		expected string
+	}{
+		{[]byte{1, 1, 0, 0, 0, 0, 0, 5, 18, 0, 0, 0}, "S-1-5-18"},
+		{[]byte{1, 2, 0, 0, 0, 0, 0, 5, 32, 0, 0, 0, 32, 2, 0, 0}, "S-1-5-32-544"},
+		{[]byte{1, 5, 0, 0, 0, 0, 0, 5, 21, 0, 0, 0, 0x15, 0xcd, 0x5b, 0x07, 0x99, 0x2c, 0x0f, 0x0a, 0x1b, 0x3d, 0x7f, 0x26, 0xf4, 0x01, 0, 0}, "S-1-5-21-123456789-168766617-645872923-500"},
+	}
+	for _, test := range tests {
+		sid, err := ldap.ParseSID(test.sid)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.expected, err)
+		} else if sid != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, sid)
+		}
+	}
+
+	for _, sid := range [][]byte{
+		{},
+		{1, 1, 0, 0, 0, 0, 0},
+		{1, 1, 0, 0, 0, 0, 0, 5, 18, 0, 0},
+		{1, 2, 0, 0, 0, 0, 0, 5, 18, 0, 0, 0},
+	} {
+		if _, err := ldap.ParseSID(sid); err == nil {
+			t.Errorf("expected error for %v", sid)
+		}
+	}
+
+	entry := ldap.NewEntry("cn=test,dc=example,dc=org", map[string][]string{
+		"objectSid": {string([]byte{1, 1, 0, 0, 0, 0, 0, 5, 18, 0, 0, 0})},
+	})
+	if sid, err := entry.GetAttributeSID("objectSid"); err != nil || sid != "S-1-5-18" {
+		t.Errorf("GetAttributeSID: expected S-1-5-18, got %q (%v)", sid, err)
+	}
+	if _, err := entry.GetAttributeSID("description"); err == nil {
+		t.Errorf("GetAttributeSID: expected error for missing attribute")
+	}
+}
+
+func TestParseGUID(t *testing.T) {
+	guid := []byte{0xee, 0xd2, 0xe2, 0x0f, 0x6b, 0x8e, 0x35, 0x4b, 0xa5, 0x4e, 0x17, 0xbc, 0xc4, 0xa2, 0xa0, 0xfd}
+	expected := "0fe2d2ee-8e6b-4b35-a54e-17bcc4a2a0fd"
+
+	if value, err := ldap.ParseGUID(guid); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if value != expected {
+		t.Errorf("expected %s, got %s", expected, value)
+	}
+
+	for _, guid := range [][]byte{{}, guid[:15], append(guid, 0)} {
+		if _, err := ldap.ParseGUID(guid); err == nil {
+			t.Errorf("expected error for %d bytes", len(guid))
+		}
+	}
+
+	entry := ldap.NewEntry("cn=test,dc=example,dc=org", map[string][]string{
+		"objectGUID": {string(guid)},
+	})
+	if value, err := entry.GetAttributeGUID("objectGUID"); err != nil || value != expected {
+		t.Errorf("GetAttributeGUID: expected %s, got %q (%v)", expected, value, err)
+	}
+}
+
+func TestParseEffectiveRights(t *testing.T) {
+	entry := ldap.NewEntry("uid=test,dc=example,dc=org", map[string][]string{
+		"uid":                           {"test"},
+		"aclRights;entryLevel":          {"add:0,delete:0,read:1,write:0,proxy:0"},
+		"aclRights;attributeLevel;cn":   {"search:1,read:1,compare:1,write:0,selfwrite_add:0,selfwrite_delete:0,proxy:0"},
+		"aclRights;attributeLevel;Mail": {"search:1,read:1,compare:1,write:1,selfwrite_add:1,selfwrite_delete:1,proxy:0"},
+	})
+	rights, err := ldap.ParseEffectiveRights(entry)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := map[string]bool{"add": false, "delete": false, "read": true, "write": false, "proxy": false}
+	if !reflect.DeepEqual(rights.Entry, expected) {
+		t.Errorf("entry level: expected %v, got %v", expected, rights.Entry)
+	}
+	if len(rights.Attributes) != 2 {
+		t.Errorf("expected rights for 2 attributes, got %v", rights.Attributes)
+	}
+	if cn := rights.Attributes["cn"]; !cn["read"] || cn["write"] {
+		t.Errorf("cn: unexpected rights %v", cn)
+	}
+	if mail := rights.Attributes["mail"]; !mail["read"] || !mail["write"] || !mail["selfwrite_delete"] {
+		t.Errorf("mail: unexpected rights %v", mail)
+	}
+
+	for _, attributes := range []map[string][]string{
+		{"uid": {"test"}},
+		{"aclRights;entryLevel": {"add:0,read"}},
+		{"aclRights;entryLevel": {"add:yes"}},
+		{"aclRights;somethingElse": {"add:0"}},
+	} {
+		if _, err := ldap.ParseEffectiveRights(ldap.NewEntry("uid=test,dc=example,dc=org", attributes)); err == nil {
+			t.Errorf("%v: expected error", attributes)
+		}
+	}
+}
@@ -164,7 +164,10 @@ func DecompileFilter(packet *ber.Packet) (ret string, err error) {
 			case MatchingRuleAssertionMatchValue:
 				value = ber.DecodeString(child.Data.Bytes())
 			case MatchingRuleAssertionDNAttributes:
-				dnAttributes = child.Value.(bool)
+				// context specific values are not decoded by ber,
+				// so look at the raw boolean instead of child.Value
+				data := child.Data.Bytes()
+				dnAttributes = len(data) == 1 && data[0] != 0
 			}
 		}
 
@@ -177,6 +177,21 @@ var testFilters = []compileTest{
 		expectedFilter: `(memberOf:1.2.840.113556.1.4.1941:=CN=User1,OU=blah,DC=mydomain,DC=net)`,
 		expectedType:   ldap.FilterExtensibleMatch,
 	},
+	compileTest{
+		filterStr:      `(cn:caseExactMatch:=X)`,
+		expectedFilter: `(cn:caseExactMatch:=X)`,
+		expectedType:   ldap.FilterExtensibleMatch,
+	},
+	compileTest{
+		filterStr:      "(|(a=1)(!(b=2)))",
+		expectedFilter: "(|(a=1)(!(b=2)))",
+		expectedType:   ldap.FilterOr,
+	},
+	compileTest{
+		filterStr:      "(cn=a*b*c)",
+		expectedFilter: "(cn=a*b*c)",
+		expectedType:   ldap.FilterSubstrings,
+	},
 
 	// compileTest{ filterStr: "()", filterType: FilterExtensibleMatch },
 }
@@ -207,6 +222,32 @@ func TestFilter(t *testing.T) {
 	}
 }
 
+// TestFilterWire tests that compiled filters survive being sent over the
+// wire, e.g. when they're embedded in a control value
+func TestFilterWire(t *testing.T) {
+	for _, i := range testFilters {
+		if i.expectedErr != "" {
+			continue
+		}
+		filter, err := ldap.CompileFilter(i.filterStr)
+		if err != nil {
+			t.Errorf("Problem compiling '%s' - '%v'", i.filterStr, err)
+			continue
+		}
+		decoded, err := ber.DecodePacketErr(filter.Bytes())
+		if err != nil {
+			t.Errorf("Problem decoding '%s' - '%v'", i.filterStr, err)
+			continue
+		}
+		o, err := ldap.DecompileFilter(decoded)
+		if err != nil {
+			t.Errorf("Problem decompiling %s - %s", i.filterStr, err.Error())
+		} else if i.expectedFilter != o {
+			t.Errorf("%q expected, got %q", i.expectedFilter, o)
+		}
+	}
+}
+
 func TestInvalidFilter(t *testing.T) {
 	for _, filterStr := range testInvalidFilters {
 		if _, err := ldap.CompileFilter(filterStr); err == nil {
@@ -152,11 +152,23 @@ func addControlDescriptions(packet *ber.Packet) {
 	packet.Description = "Controls"
 	for _, child := range packet.Children {
 		child.Description = "Control"
+		// this runs before the controls are decoded, so don't trust
+		// the structure
+		if !isControlPacket(child) {
+			continue
+		}
 		child.Children[0].Description = "Control Type (" + ControlTypeMap[child.Children[0].Value.(string)] + ")"
+		if len(child.Children) == 1 {
+			continue
+		}
 		value := child.Children[1]
 		if len(child.Children) == 3 {
 			child.Children[1].Description = "Criticality"
 			value = child.Children[2]
+		} else if _, ok := value.Value.(bool); ok {
+			// a valueless control with criticality
+			value.Description = "Criticality"
+			continue
 		}
 		value.Description = "Control Value"
 
@@ -165,11 +177,17 @@ func addControlDescriptions(packet *ber.Packet) {
 			value.Description += " (Paging)"
 			if value.Value != nil {
 				valueChildren := ber.DecodePacket(value.Data.Bytes())
+				if valueChildren == nil || len(valueChildren.Children) != 2 {
+					continue
+				}
 				value.Data.Truncate(0)
 				value.Value = nil
 				valueChildren.Children[1].Value = valueChildren.Children[1].Data.Bytes()
 				value.AppendChild(valueChildren)
 			}
+			if len(value.Children) == 0 || len(value.Children[0].Children) != 2 {
+				continue
+			}
 			value.Children[0].Description = "Real Search Control Value"
 			value.Children[0].Children[0].Description = "Paging Size"
 			value.Children[0].Children[1].Description = "Cookie"
@@ -178,18 +196,32 @@ func addControlDescriptions(packet *ber.Packet) {
 			value.Description += " (Password Policy - Behera Draft)"
 			if value.Value != nil {
 				valueChildren := ber.DecodePacket(value.Data.Bytes())
+				if valueChildren == nil {
+					continue
+				}
 				value.Data.Truncate(0)
 				value.Value = nil
 				value.AppendChild(valueChildren)
 			}
+			if len(value.Children) == 0 {
+				continue
+			}
 			sequence := value.Children[0]
 			for _, child := range sequence.Children {
+				if child.ClassType != ber.ClassContext {
+					continue
+				}
 				if child.Tag == 0 {
 					//Warning
+					if len(child.Children) == 0 {
+						continue
+					}
 					child := child.Children[0]
-					packet := ber.DecodePacket(child.Data.Bytes())
-					val, ok := packet.Value.(int64)
-					if ok {
+					if child.ClassType != ber.ClassContext || child.TagType != ber.TypePrimitive {
+						continue
+					}
+					val, err := ber.ParseInt64(child.Data.Bytes())
+					if err == nil {
 						if child.Tag == 0 {
 							//timeBeforeExpiration
 							value.Description += " (TimeBeforeExpiration)"
@@ -202,13 +234,15 @@ func addControlDescriptions(packet *ber.Packet) {
 					}
 				} else if child.Tag == 1 {
 					// Error
-					packet := ber.DecodePacket(child.Data.Bytes())
-					val, ok := packet.Value.(int8)
-					if !ok {
+					if child.TagType != ber.TypePrimitive {
+						continue
+					}
+					val, err := ber.ParseInt64(child.Data.Bytes())
+					if err != nil || val < BeheraPasswordExpired || val > BeheraPasswordInHistory {
 						val = -1
 					}
 					child.Description = "Error"
-					child.Value = val
+					child.Value = int8(val)
 				}
 			}
 		}
@@ -253,6 +253,32 @@ func TestEscapeFilter(t *testing.T) {
 	}
 }
 
+func TestEscapeFilterTable(t *testing.T) {
+	var tests = []struct {
+		value    string
+		expected string
+	}{
+		{"", ""},
+		{"plain value", "plain value"},
+		{"a\x00b(c)d*e\\f", `a\00b\28c\29d\2ae\5cf`},
+		{"*", `\2a`},
+		{"(cn=*)", `\28cn=\2a\29`},
+		{`\2a`, `\5c2a`},
+		{"\x00\x00", `\00\00`},
+		{"\x7f", "\x7f"},
+		{"Lučić", `Lu\c4\8di\c4\87`},
+		{"日本", `\e6\97\a5\e6\9c\ac`},
+		{"€*", `\e2\82\ac\2a`},
+		{"😀", `\f0\9f\98\80`},
+		{"\xff", `\ff`},
+	}
+	for _, test := range tests {
+		if got := ldap.EscapeFilter(test.value); got != test.expected {
+			t.Errorf("EscapeFilter(%q): got %s, expected %s", test.value, got, test.expected)
+		}
+	}
+}
+
 func TestCompare(t *testing.T) {
 	fmt.Printf("TestCompare: starting...\n")
 	l, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", ldapServer, ldapPort))
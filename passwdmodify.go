@@ -24,6 +24,7 @@ type PasswordModifyRequest struct {
 
 type PasswordModifyResult struct {
 	GeneratedPassword string
+	Controls          []Control
 }
 
 func (r *PasswordModifyRequest) encode() (*ber.Packet, error) {
@@ -115,9 +116,17 @@ func (l *Conn) PasswordModify(passwordModifyRequest *PasswordModifyRequest) (*Pa
 	}
 
 	if packet.Children[1].Tag == ApplicationExtendedResponse {
+		// decode the controls first, the password policy control
+		// tells why a modification failed
+		controls, err := DecodeResponseControls(packet)
+		if err != nil {
+			l.Debug.Printf("%d: ignoring controls: %s", msgCtx.id, err)
+			controls = []Control{}
+		}
+		result.Controls = controls
 		resultCode, resultDescription := getLDAPResultCode(packet)
 		if resultCode != 0 {
-			return nil, NewError(resultCode, errors.New(resultDescription))
+			return result, NewError(resultCode, errors.New(resultDescription))
 		}
 	} else {
 		return nil, NewError(ErrorUnexpectedResponse, fmt.Errorf("Unexpected Response: %d", packet.Children[1].Tag))
@@ -0,0 +1,32 @@
+package ldap
+
+import (
+	"testing"
+
+	"gopkg.in/asn1-ber.v1"
+)
+
+func TestPasswordModifyResultControls(t *testing.T) {
+	ptc := newPacketTranslatorConn()
+	defer ptc.Close()
+	conn := NewConn(ptc, false)
+	conn.Start()
+	defer conn.Close()
+
+	tooShort := ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 1, BeheraPasswordTooShort, "Error")
+	// the broken control must not take the password policy with it
+	broken := NewControlString(ControlTypeVChuPasswordWarning, false, "soon")
+	controls := WrapRawControls([][]byte{broken.Encode().Bytes(), encodeBeheraResponse(tooShort).Bytes()})
+	go testRespond(t, ptc, testResult(ApplicationExtendedResponse, LDAPResultConstraintViolation), controls)
+
+	result, err := conn.PasswordModify(NewPasswordModifyRequest("", "old", "new"))
+	if !IsErrorWithCode(err, LDAPResultConstraintViolation) {
+		t.Errorf("expected constraint violation, got %v", err)
+	}
+	if result == nil {
+		t.Fatalf("expected a result with the controls")
+	}
+	if c, ok := PasswordPolicyFromControls(result.Controls); !ok || c.Error != BeheraPasswordTooShort {
+		t.Errorf("expected password too short, got %v", result.Controls)
+	}
+}
@@ -284,6 +284,10 @@ func (l *Conn) SearchWithPaging(searchRequest *SearchRequest, pagingSize uint32)
 		pagingControl = NewControlPaging(pagingSize)
 		searchRequest.Controls = append(searchRequest.Controls, pagingControl)
 	} else {
+		// the cookie is set on the wrapped control
+		if wrapped, ok := control.(*ControlExplicitCriticality); ok {
+			control = wrapped.Control
+		}
 		castControl, ok := control.(*ControlPaging)
 		if !ok {
 			return nil, fmt.Errorf("Expected paging control to be of type *ControlPaging, got %v", control)
@@ -324,7 +328,7 @@ func (l *Conn) SearchWithPaging(searchRequest *SearchRequest, pagingSize uint32)
 		}
 
 		cookie := pagingResult.(*ControlPaging).Cookie
-		if len(cookie) == 0 {
+		if cookie.IsEmpty() {
 			pagingControl = nil
 			l.Debug.Printf("Could not find cookie.  Breaking...")
 			break
@@ -352,7 +356,7 @@ func (l *Conn) Search(searchRequest *SearchRequest) (*SearchResult, error) {
 	packet.AppendChild(encodedSearchRequest)
 	// encode search controls
 	if searchRequest.Controls != nil {
-		packet.AppendChild(encodeControls(searchRequest.Controls))
+		packet.AppendChild(EncodeControls(searchRequest.Controls))
 	}
 
 	l.Debug.PrintPacket(packet)
@@ -407,11 +411,11 @@ func (l *Conn) Search(searchRequest *SearchRequest) (*SearchResult, error) {
 			if resultCode != 0 {
 				return result, NewError(resultCode, errors.New(resultDescription))
 			}
-			if len(packet.Children) == 3 {
-				for _, child := range packet.Children[2].Children {
-					result.Controls = append(result.Controls, DecodeControl(child))
-				}
+			controls, err := DecodeResponseControls(packet)
+			if err != nil {
+				l.Debug.Printf("%d: ignoring controls: %s", msgCtx.id, err)
 			}
+			result.Controls = append(result.Controls, controls...)
 			foundSearchResultDone = true
 		case 19:
 			result.Referrals = append(result.Referrals, packet.Children[1].Children[0].Value.(string))